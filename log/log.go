@@ -0,0 +1,102 @@
+// Package log provides Inbucket's logging facade: plain printf-style
+// functions for simple messages, and a Logger interface for call sites
+// that want to attach structured key/value context to a run of related
+// log lines (e.g. everything belonging to one retention scan).
+package log
+
+import (
+	"fmt"
+	stdlog "log"
+	"os"
+)
+
+var std = stdlog.New(os.Stderr, "", stdlog.LstdFlags)
+
+// Tracef logs a trace-level message. This package applies no level
+// filtering, so trace messages are always written.
+func Tracef(format string, args ...interface{}) {
+	std.Printf("TRACE "+format, args...)
+}
+
+// Debugf logs a debug-level message.
+func Debugf(format string, args ...interface{}) {
+	std.Printf("DEBUG "+format, args...)
+}
+
+// Infof logs an info-level message.
+func Infof(format string, args ...interface{}) {
+	std.Printf("INFO  "+format, args...)
+}
+
+// Errorf logs an error-level message.
+func Errorf(format string, args ...interface{}) {
+	std.Printf("ERROR "+format, args...)
+}
+
+// Logger is a structured logger that carries a set of key/value fields
+// into every message it logs, so related log lines can be correlated
+// without repeating context in every call.
+type Logger interface {
+	// With returns a child Logger that also includes key=value, in
+	// addition to any fields already attached to this Logger.
+	With(key string, value interface{}) Logger
+
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NewLogger returns a Logger with no fields attached.
+func NewLogger() Logger {
+	return fieldLogger{}
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+type fieldLogger struct {
+	fields []field
+}
+
+// With implements Logger.
+func (l fieldLogger) With(key string, value interface{}) Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	fields = append(fields, field{key, value})
+	return fieldLogger{fields: fields}
+}
+
+func (l fieldLogger) Tracef(format string, args ...interface{}) {
+	f, a := l.annotate(format, args)
+	Tracef(f, a...)
+}
+
+func (l fieldLogger) Debugf(format string, args ...interface{}) {
+	f, a := l.annotate(format, args)
+	Debugf(f, a...)
+}
+
+func (l fieldLogger) Infof(format string, args ...interface{}) {
+	f, a := l.annotate(format, args)
+	Infof(f, a...)
+}
+
+func (l fieldLogger) Errorf(format string, args ...interface{}) {
+	f, a := l.annotate(format, args)
+	Errorf(f, a...)
+}
+
+// annotate appends this Logger's fields to format as "key=%v" verbs, with
+// the field values passed through as arguments rather than interpolated
+// directly into the format string, so a value containing a literal '%'
+// (e.g. a mailbox name or message ID) can't be misread as a printf verb.
+func (l fieldLogger) annotate(format string, args []interface{}) (string, []interface{}) {
+	for _, f := range l.fields {
+		format = fmt.Sprintf("%s %s=%%v", format, f.key)
+		args = append(args, f.value)
+	}
+	return format, args
+}
@@ -2,28 +2,41 @@ package smtpd
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"expvar"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jhillyerd/inbucket/config"
 	"github.com/jhillyerd/inbucket/log"
 )
 
+// ErrScanInProgress is returned by TriggerRetentionScan when a scan is
+// already running; the caller should treat this as non-fatal.
+var ErrScanInProgress = errors.New("retention scan already in progress")
+
 var (
 	retentionScanCompleted   = time.Now()
 	retentionScanCompletedMu sync.RWMutex
 
-	// Indicates Inbucket needs to shut down
-	globalShutdown chan bool
-	// Indicates the retention scanner has shut down
-	retentionShutdown chan bool
-
 	// History counters
 	expRetentionDeletesTotal = new(expvar.Int)
 	expRetentionPeriod       = new(expvar.Int)
 	expRetainedCurrent       = new(expvar.Int)
 
+	// Human-readable description of the currently active policy set
+	expRetentionPolicy = new(expvar.String)
+
+	// Per-scan progress, refreshed at the end of every scan; InFlightWorkers
+	// is instead updated as each worker starts and finishes a mailbox
+	expRetentionScanDurationSeconds = new(expvar.Float)
+	expRetentionMailboxesScanned    = new(expvar.Int)
+	expRetentionMessagesConsidered  = new(expvar.Int)
+	expRetentionInFlightWorkers     = new(expvar.Int)
+
 	// History of certain stats
 	retentionDeletesHist = list.New()
 	retainedHist         = list.New()
@@ -31,27 +44,169 @@ var (
 	// History rendered as comma delimited string
 	expRetentionDeletesHist = new(expvar.String)
 	expRetainedHist         = new(expvar.String)
+
+	// scanIDSeq assigns each scan a unique, increasing ID for log correlation
+	scanIDSeq int64
 )
 
-// StartRetentionScanner launches a go-routine that scans for expired
-// messages, following the configured interval
-func StartRetentionScanner(ds DataStore, shutdownChannel chan bool) {
-	globalShutdown = shutdownChannel
-	retentionShutdown = make(chan bool)
+// RetentionScanner periodically purges expired messages from the DataStore.
+// It is bound to a context.Context rather than package-level globals so
+// that multiple instances may be started within the same process, such as
+// in tests.
+type RetentionScanner struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	trigger chan struct{}
+
+	statusMu sync.RWMutex
+	status   RetentionScanStatus
+}
+
+// RetentionScanStatus reports the progress of the retention scanner, for
+// display on the admin status endpoint.
+type RetentionScanStatus struct {
+	Running            bool      `json:"running"`
+	Phase              string    `json:"phase"`
+	LastRun            time.Time `json:"lastRun"`
+	MailboxesCompleted int       `json:"mailboxesCompleted"`
+	MailboxesTotal     int       `json:"mailboxesTotal"`
+	DeletesSoFar       int64     `json:"deletesSoFar"`
+}
+
+// StartRetentionScanner launches a goroutine that scans for expired
+// messages, following the configured interval. The scanner stops as soon
+// as ctx is canceled, or when Shutdown() is called.
+func StartRetentionScanner(ctx context.Context, ds DataStore) *RetentionScanner {
 	cfg := config.GetDataStoreConfig()
 	expRetentionPeriod.Set(int64(cfg.RetentionMinutes * 60))
+
+	ctx, cancel := context.WithCancel(ctx)
+	rs := &RetentionScanner{
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		trigger: make(chan struct{}, 1),
+		status:  RetentionScanStatus{Phase: "idle"},
+	}
+
 	if cfg.RetentionMinutes > 0 {
+		policy := buildRetentionPolicy(cfg)
+		expRetentionPolicy.Set(describePolicy(policy))
+
+		concurrency := cfg.RetentionConcurrency
+		if concurrency < 1 {
+			// Default to sequential scanning for backwards compatibility
+			concurrency = 1
+		}
+
 		// Retention scanning enabled
-		log.Infof("Retention configured for %v minutes", cfg.RetentionMinutes)
-		go retentionScanner(ds, time.Duration(cfg.RetentionMinutes)*time.Minute,
-			time.Duration(cfg.RetentionSleep)*time.Millisecond)
+		log.Infof("Retention configured for %v minutes, concurrency %d", cfg.RetentionMinutes, concurrency)
+		go rs.run(ctx, ds, policy, concurrency, time.Duration(cfg.RetentionSleep)*time.Millisecond)
 	} else {
 		log.Infof("Retention scanner disabled")
-		close(retentionShutdown)
+		close(rs.done)
+	}
+
+	return rs
+}
+
+// buildRetentionPolicy composes the configured RetentionPolicy set. The
+// legacy RetentionMinutes max-age policy is always applied; RetentionMaxMessages
+// and RetentionMaxBytes add mailbox-scoped caps on top of it. Multiple
+// policies are combined according to RetentionPolicyMode, which defaults to
+// "and" (a message must satisfy every policy to be retained).
+func buildRetentionPolicy(cfg config.DataStoreConfig) RetentionPolicy {
+	policies := []RetentionPolicy{
+		&MaxAgePolicy{MaxAge: time.Duration(cfg.RetentionMinutes) * time.Minute},
 	}
+	if cfg.RetentionMaxMessages > 0 {
+		policies = append(policies, &MaxMessagesPolicy{Max: cfg.RetentionMaxMessages})
+	}
+	if cfg.RetentionMaxBytes > 0 {
+		policies = append(policies, &MaxSizePolicy{MaxBytes: cfg.RetentionMaxBytes})
+	}
+	if len(policies) == 1 {
+		return policies[0]
+	}
+	if cfg.RetentionPolicyMode == "or" {
+		return &OrPolicy{Policies: policies}
+	}
+	return &AndPolicy{Policies: policies}
+}
+
+func describePolicy(policy RetentionPolicy) string {
+	if stringer, ok := policy.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return "policy"
+}
+
+// Shutdown requests the scanner stop, canceling any scan in progress, and
+// blocks until it has done so.
+func (rs *RetentionScanner) Shutdown() {
+	rs.cancel()
+	rs.Wait()
+}
+
+// Wait blocks until the retention scanner has shut down.
+func (rs *RetentionScanner) Wait() {
+	<-rs.done
+}
+
+// TriggerRetentionScan requests an immediate scan, bypassing the normal
+// once-a-minute throttle. It returns ErrScanInProgress if a scan is
+// already running. triggeredBy identifies who asked for the scan, for
+// logging.
+func (rs *RetentionScanner) TriggerRetentionScan(triggeredBy string) error {
+	if rs.Status().Running {
+		return ErrScanInProgress
+	}
+
+	log.NewLogger().With("triggered_by", triggeredBy).Infof("Retention scan triggered on demand")
+	select {
+	case rs.trigger <- struct{}{}:
+	default:
+		// A trigger is already queued; no need for another.
+	}
+	return nil
+}
+
+// Status returns a snapshot of the scanner's current progress.
+func (rs *RetentionScanner) Status() RetentionScanStatus {
+	rs.statusMu.RLock()
+	defer rs.statusMu.RUnlock()
+	return rs.status
+}
+
+func (rs *RetentionScanner) beginScan() {
+	rs.statusMu.Lock()
+	rs.status.Running = true
+	rs.status.Phase = "scanning"
+	rs.status.MailboxesCompleted = 0
+	rs.status.MailboxesTotal = 0
+	rs.status.DeletesSoFar = 0
+	rs.statusMu.Unlock()
+}
+
+func (rs *RetentionScanner) endScan() {
+	rs.statusMu.Lock()
+	rs.status.Running = false
+	rs.status.Phase = "idle"
+	rs.status.LastRun = time.Now()
+	rs.statusMu.Unlock()
+}
+
+// reportProgress is passed to doRetentionScan as its progress callback.
+func (rs *RetentionScanner) reportProgress(completed, total int, deletesSoFar int64) {
+	rs.statusMu.Lock()
+	rs.status.MailboxesCompleted = completed
+	rs.status.MailboxesTotal = total
+	rs.status.DeletesSoFar = deletesSoFar
+	rs.statusMu.Unlock()
 }
 
-func retentionScanner(ds DataStore, maxAge time.Duration, sleep time.Duration) {
+func (rs *RetentionScanner) run(ctx context.Context, ds DataStore, policy RetentionPolicy, concurrency int, sleep time.Duration) {
+	defer close(rs.done)
+
 	start := time.Now()
 retentionLoop:
 	for {
@@ -61,83 +216,171 @@ retentionLoop:
 			dur := time.Minute - since
 			log.Tracef("Retention scanner sleeping for %v", dur)
 			select {
-			case _ = <-globalShutdown:
+			case <-ctx.Done():
 				break retentionLoop
-			case _ = <-time.After(dur):
+			case <-rs.trigger:
+				log.Infof("Retention scan starting early due to trigger")
+			case <-time.After(dur):
 			}
 		}
 
 		// Kickoff scan
 		start = time.Now()
-		if err := doRetentionScan(ds, maxAge, sleep); err != nil {
+		rs.beginScan()
+		err := doRetentionScan(ctx, ds, policy, concurrency, sleep, rs.reportProgress)
+		rs.endScan()
+		if err != nil {
 			log.Errorf("Error during retention scan: %v", err)
 		}
 
-		// Check for global shutdown
+		// Check for shutdown
 		select {
-		case _ = <-globalShutdown:
+		case <-ctx.Done():
 			break retentionLoop
 		default:
 		}
 	}
 
 	log.Tracef("Retention scanner shut down")
-	close(retentionShutdown)
 }
 
-// doRetentionScan does a single pass of all mailboxes looking for messages that can be purged
-func doRetentionScan(ds DataStore, maxAge time.Duration, sleep time.Duration) error {
-	log.Tracef("Starting retention scan")
-	cutoff := time.Now().Add(-1 * maxAge)
+// doRetentionScan does a single pass of all mailboxes looking for messages
+// that can be purged. Mailboxes are distributed across a pool of
+// `concurrency` workers, so one slow or huge mailbox doesn't stall the
+// others; the pool size bounds the number of goroutines regardless of how
+// many mailboxes exist. It checks ctx for cancellation between individual
+// messages and mailboxes, so a slow scan can still be interrupted promptly.
+// A worker's failure to delete one message is logged and does not affect
+// any other worker. onProgress, if non-nil, is called after each mailbox
+// finishes with the running totals, so callers can surface scan progress
+// (e.g. the admin status endpoint).
+func doRetentionScan(ctx context.Context, ds DataStore, policy RetentionPolicy, concurrency int, sleep time.Duration, onProgress func(completed, total int, deletesSoFar int64)) error {
+	start := time.Now()
+	scanID := atomic.AddInt64(&scanIDSeq, 1)
+	scanLog := log.NewLogger().With("scan_id", scanID).With("scan_start", start)
+	scanLog.Debugf("Starting retention scan")
+
+	resetPolicy(policy)
+
 	mboxes, err := ds.AllMailboxes()
 	if err != nil {
 		return err
 	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if onProgress != nil {
+		onProgress(0, len(mboxes), 0)
+	}
 
-	retained := 0
-	for _, mb := range mboxes {
-		messages, err := mb.GetMessages()
-		if err != nil {
-			return err
-		}
-		for _, msg := range messages {
-			if msg.Date().Before(cutoff) {
-				log.Tracef("Purging expired message %v", msg.ID())
-				err = msg.Delete()
-				if err != nil {
-					// Log but don't abort
-					log.Errorf("Failed to purge message %v: %v", msg.ID(), err)
-				} else {
-					expRetentionDeletesTotal.Add(1)
+	var (
+		scanned    int64
+		considered int64
+		retained   int64
+		deleted    int64
+		errored    int64
+		inFlight   int32
+	)
+
+	jobs := make(chan Mailbox)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for mb := range jobs {
+				n := atomic.AddInt32(&inFlight, 1)
+				expRetentionInFlightWorkers.Set(int64(n))
+
+				c, r, d, e := scanMailbox(ctx, mb, policy, scanLog)
+				atomic.AddInt64(&considered, c)
+				atomic.AddInt64(&retained, r)
+				atomic.AddInt64(&errored, e)
+				deletesSoFar := atomic.AddInt64(&deleted, d)
+				completed := atomic.AddInt64(&scanned, 1)
+
+				n = atomic.AddInt32(&inFlight, -1)
+				expRetentionInFlightWorkers.Set(int64(n))
+
+				if onProgress != nil {
+					onProgress(int(completed), len(mboxes), deletesSoFar)
+				}
+
+				// Pace ourselves between mailboxes
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(sleep):
 				}
-			} else {
-				retained++
 			}
-		}
-		// Check for shutdown
+		}()
+	}
+
+feedLoop:
+	for _, mb := range mboxes {
 		select {
-		case _ = <-globalShutdown:
-			log.Tracef("Retention scan aborted due to shutdown")
-			return nil
-		default:
+		case <-ctx.Done():
+			scanLog.Debugf("Retention scan aborted due to shutdown")
+			break feedLoop
+		case jobs <- mb:
 		}
-		// Sleep after completing a mailbox
-		time.Sleep(sleep)
 	}
+	close(jobs)
+	wg.Wait()
 
+	expRetentionScanDurationSeconds.Set(time.Since(start).Seconds())
+	expRetentionMailboxesScanned.Set(scanned)
+	expRetentionMessagesConsidered.Set(considered)
 	setRetentionScanCompleted(time.Now())
-	expRetainedCurrent.Set(int64(retained))
+	expRetainedCurrent.Set(retained)
+
+	scanLog.Infof("Retention scan complete: deleted=%d retained=%d errors=%d duration=%v",
+		deleted, retained, errored, time.Since(start))
 
 	return nil
 }
 
-// RetentionJoin does not retun until the retention scanner has shut down
-func RetentionJoin() {
-	if retentionShutdown != nil {
+// scanMailbox evaluates every message in mb against policy, deleting those
+// it rejects. It returns the number of messages considered, the number
+// retained, the number deleted, and the number of delete errors. A
+// message's delete error is logged and otherwise ignored so it cannot
+// halt the scan of this or any other mailbox. scanLog is the per-scan
+// logger, which this function annotates with mailbox and message fields.
+func scanMailbox(ctx context.Context, mb Mailbox, policy RetentionPolicy, scanLog log.Logger) (considered, retained, deleted, errored int64) {
+	mbLog := scanLog.With("mailbox", mb.Name())
+
+	messages, err := mb.GetMessages()
+	if err != nil {
+		mbLog.Errorf("Failed to list messages: %v", err)
+		return 0, 0, 0, 0
+	}
+	preparePolicy(policy, mb, messages)
+
+	for _, msg := range messages {
 		select {
-		case _ = <-retentionShutdown:
+		case <-ctx.Done():
+			return considered, retained, deleted, errored
+		default:
+		}
+
+		msgLog := mbLog.With("msgid", msg.ID())
+		considered++
+		if keep, reason := policy.ShouldRetain(msg, mb); !keep {
+			msgLog.Debugf("Purging expired message: %v", reason)
+			if err := msg.Delete(); err != nil {
+				// Log but don't abort; other messages/mailboxes are unaffected
+				msgLog.Errorf("Failed to purge message: %v", err)
+				errored++
+			} else {
+				expRetentionDeletesTotal.Add(1)
+				deleted++
+			}
+		} else {
+			retained++
 		}
 	}
+
+	return considered, retained, deleted, errored
 }
 
 func setRetentionScanCompleted(t time.Time) {
@@ -166,4 +409,9 @@ func init() {
 	rm.Set("Period", expRetentionPeriod)
 	rm.Set("RetainedHist", expRetainedHist)
 	rm.Set("RetainedCurrent", expRetainedCurrent)
+	rm.Set("Policy", expRetentionPolicy)
+	rm.Set("ScanDurationSeconds", expRetentionScanDurationSeconds)
+	rm.Set("MailboxesScanned", expRetentionMailboxesScanned)
+	rm.Set("MessagesConsidered", expRetentionMessagesConsidered)
+	rm.Set("InFlightWorkers", expRetentionInFlightWorkers)
 }
@@ -0,0 +1,54 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jhillyerd/inbucket/log"
+)
+
+// ScanHandler implements the administrative scan-now endpoint:
+// POST /admin/retention/scan
+//
+// It kicks off an immediate retention scan without waiting for the usual
+// once-a-minute throttle. Responds 202 Accepted if the scan was queued, or
+// 409 Conflict if one is already running.
+func (rs *RetentionScanner) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	triggeredBy := r.Header.Get("X-Inbucket-User")
+	if triggeredBy == "" {
+		triggeredBy = r.RemoteAddr
+	}
+
+	if err := rs.TriggerRetentionScan(triggeredBy); err != nil {
+		if err == ErrScanInProgress {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// StatusHandler implements the scan-status endpoint:
+// GET /admin/retention/status
+//
+// It reports the last scan time, current phase, and progress of any scan
+// in flight, so operators can watch a triggered scan to completion.
+func (rs *RetentionScanner) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rs.Status()); err != nil {
+		log.Errorf("Failed to encode retention status: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newIdleScanner() *RetentionScanner {
+	return &RetentionScanner{
+		trigger: make(chan struct{}, 1),
+		status:  RetentionScanStatus{Phase: "idle"},
+	}
+}
+
+func TestScanHandlerAcceptsWhenIdle(t *testing.T) {
+	rs := newIdleScanner()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/retention/scan", nil)
+	w := httptest.NewRecorder()
+	rs.ScanHandler(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+}
+
+func TestScanHandlerConflictsWhenRunning(t *testing.T) {
+	rs := newIdleScanner()
+	rs.statusMu.Lock()
+	rs.status.Running = true
+	rs.statusMu.Unlock()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/retention/scan", nil)
+	w := httptest.NewRecorder()
+	rs.ScanHandler(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d when a scan is already running", w.Code, http.StatusConflict)
+	}
+}
+
+func TestScanHandlerRejectsWrongMethod(t *testing.T) {
+	rs := newIdleScanner()
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/retention/scan", nil)
+	w := httptest.NewRecorder()
+	rs.ScanHandler(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestStatusHandlerReportsCurrentStatus(t *testing.T) {
+	rs := newIdleScanner()
+	rs.statusMu.Lock()
+	rs.status = RetentionScanStatus{
+		Running:            true,
+		Phase:              "scanning",
+		MailboxesCompleted: 2,
+		MailboxesTotal:     5,
+		DeletesSoFar:       3,
+	}
+	rs.statusMu.Unlock()
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/retention/status", nil)
+	w := httptest.NewRecorder()
+	rs.StatusHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+
+	var got RetentionScanStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode response body: %v", err)
+	}
+	want := rs.Status()
+	if got != want {
+		t.Errorf("decoded status = %+v, want %+v", got, want)
+	}
+}
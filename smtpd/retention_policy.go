@@ -0,0 +1,276 @@
+package smtpd
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy decides whether a single message should survive a
+// retention scan. Implementations may be stateless (max-age) or may need
+// to see every message in a mailbox before deciding (max-messages,
+// max-size), in which case they implement preparable so scanMailbox can
+// hand them the mailbox's message list (already fetched once, for every
+// policy to share) before asking about individual messages. Implementations
+// with per-scan state should also implement resettable so doRetentionScan
+// can clear that cache at the start of each scan.
+type RetentionPolicy interface {
+	// ShouldRetain reports whether msg should be kept. When keep is
+	// false, reason is a short human-readable explanation suitable for
+	// logging.
+	ShouldRetain(msg Message, mb Mailbox) (keep bool, reason string)
+}
+
+// resettable is implemented by policies that cache per-mailbox state
+// across the ShouldRetain calls of a single scan; doRetentionScan resets
+// this state before each scan begins.
+type resettable interface {
+	reset()
+}
+
+// resetPolicy clears any per-scan state held by policy, if it supports
+// resetting.
+func resetPolicy(policy RetentionPolicy) {
+	if r, ok := policy.(resettable); ok {
+		r.reset()
+	}
+}
+
+// preparable is implemented by policies that need to see every message in
+// a mailbox before they can answer ShouldRetain for any one of them (e.g.
+// ranking by age to keep the newest N). scanMailbox calls prepareMailbox
+// once per mailbox, passing the message list it already fetched, so
+// multiple such policies composed together don't each re-list the mailbox.
+type preparable interface {
+	prepareMailbox(mb Mailbox, messages []Message)
+}
+
+// preparePolicy hands messages, the already-fetched contents of mb, to
+// policy, if it needs to see them ahead of ShouldRetain.
+func preparePolicy(policy RetentionPolicy, mb Mailbox, messages []Message) {
+	if p, ok := policy.(preparable); ok {
+		p.prepareMailbox(mb, messages)
+	}
+}
+
+// MaxAgePolicy retains messages newer than MaxAge.
+type MaxAgePolicy struct {
+	MaxAge time.Duration
+}
+
+// ShouldRetain implements RetentionPolicy.
+func (p *MaxAgePolicy) ShouldRetain(msg Message, mb Mailbox) (bool, string) {
+	if msg.Date().Before(time.Now().Add(-p.MaxAge)) {
+		return false, fmt.Sprintf("older than max age %v", p.MaxAge)
+	}
+	return true, ""
+}
+
+func (p *MaxAgePolicy) String() string {
+	return fmt.Sprintf("max-age(%v)", p.MaxAge)
+}
+
+// MaxMessagesPolicy retains only the newest Max messages in each mailbox,
+// deleting the rest.
+type MaxMessagesPolicy struct {
+	Max int
+
+	mu    sync.Mutex
+	order map[string][]string // mailbox name -> message IDs, newest first
+}
+
+// ShouldRetain implements RetentionPolicy.
+func (p *MaxMessagesPolicy) ShouldRetain(msg Message, mb Mailbox) (bool, string) {
+	ids := p.orderFor(mb)
+	for i, id := range ids {
+		if id == msg.ID() {
+			if i < p.Max {
+				return true, ""
+			}
+			return false, fmt.Sprintf("exceeds max %d messages per mailbox", p.Max)
+		}
+	}
+	// Message wasn't present in the mailbox we were prepared with; err on
+	// the side of keeping it rather than deleting something we never
+	// ranked.
+	return true, ""
+}
+
+// prepareMailbox implements preparable, ranking messages newest-first so
+// ShouldRetain can look up each message's rank without re-listing mb.
+func (p *MaxMessagesPolicy) prepareMailbox(mb Mailbox, messages []Message) {
+	sorted := append([]Message(nil), messages...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Date().After(sorted[j].Date())
+	})
+	ids := make([]string, len(sorted))
+	for i, m := range sorted {
+		ids[i] = m.ID()
+	}
+
+	p.mu.Lock()
+	if p.order == nil {
+		p.order = make(map[string][]string)
+	}
+	p.order[mb.Name()] = ids
+	p.mu.Unlock()
+}
+
+func (p *MaxMessagesPolicy) orderFor(mb Mailbox) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.order[mb.Name()]
+}
+
+func (p *MaxMessagesPolicy) reset() {
+	p.mu.Lock()
+	p.order = nil
+	p.mu.Unlock()
+}
+
+func (p *MaxMessagesPolicy) String() string {
+	return fmt.Sprintf("max-messages(%d)", p.Max)
+}
+
+// MaxSizePolicy retains the newest messages in each mailbox until their
+// combined size would exceed MaxBytes, deleting the rest.
+type MaxSizePolicy struct {
+	MaxBytes int64
+
+	mu     sync.Mutex
+	retain map[string]map[string]bool // mailbox name -> message ID -> keep
+}
+
+// ShouldRetain implements RetentionPolicy.
+func (p *MaxSizePolicy) ShouldRetain(msg Message, mb Mailbox) (bool, string) {
+	retain := p.retainFor(mb)
+	if retain[msg.ID()] {
+		return true, ""
+	}
+	return false, fmt.Sprintf("mailbox exceeds max size %d bytes", p.MaxBytes)
+}
+
+// prepareMailbox implements preparable, deciding which of messages fit
+// within MaxBytes (newest first) without re-listing mb.
+func (p *MaxSizePolicy) prepareMailbox(mb Mailbox, messages []Message) {
+	sorted := append([]Message(nil), messages...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Date().After(sorted[j].Date())
+	})
+
+	retain := make(map[string]bool)
+	var total int64
+	for _, m := range sorted {
+		total += m.Size()
+		if total > p.MaxBytes {
+			break
+		}
+		retain[m.ID()] = true
+	}
+
+	p.mu.Lock()
+	if p.retain == nil {
+		p.retain = make(map[string]map[string]bool)
+	}
+	p.retain[mb.Name()] = retain
+	p.mu.Unlock()
+}
+
+func (p *MaxSizePolicy) retainFor(mb Mailbox) map[string]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.retain[mb.Name()]
+}
+
+func (p *MaxSizePolicy) reset() {
+	p.mu.Lock()
+	p.retain = nil
+	p.mu.Unlock()
+}
+
+func (p *MaxSizePolicy) String() string {
+	return fmt.Sprintf("max-size(%d bytes)", p.MaxBytes)
+}
+
+// AndPolicy retains a message only if every sub-policy agrees to retain
+// it; the first sub-policy to reject the message supplies the reason.
+type AndPolicy struct {
+	Policies []RetentionPolicy
+}
+
+// ShouldRetain implements RetentionPolicy.
+func (p *AndPolicy) ShouldRetain(msg Message, mb Mailbox) (bool, string) {
+	for _, sub := range p.Policies {
+		if keep, reason := sub.ShouldRetain(msg, mb); !keep {
+			return false, reason
+		}
+	}
+	return true, ""
+}
+
+func (p *AndPolicy) reset() {
+	for _, sub := range p.Policies {
+		resetPolicy(sub)
+	}
+}
+
+func (p *AndPolicy) prepareMailbox(mb Mailbox, messages []Message) {
+	for _, sub := range p.Policies {
+		preparePolicy(sub, mb, messages)
+	}
+}
+
+func (p *AndPolicy) String() string {
+	return joinPolicies(p.Policies, " AND ")
+}
+
+// OrPolicy retains a message if any sub-policy agrees to retain it; it is
+// only deleted once every sub-policy has rejected it.
+type OrPolicy struct {
+	Policies []RetentionPolicy
+}
+
+// ShouldRetain implements RetentionPolicy.
+func (p *OrPolicy) ShouldRetain(msg Message, mb Mailbox) (bool, string) {
+	reason := ""
+	for _, sub := range p.Policies {
+		keep, r := sub.ShouldRetain(msg, mb)
+		if keep {
+			return true, ""
+		}
+		reason = r
+	}
+	return false, reason
+}
+
+func (p *OrPolicy) reset() {
+	for _, sub := range p.Policies {
+		resetPolicy(sub)
+	}
+}
+
+func (p *OrPolicy) prepareMailbox(mb Mailbox, messages []Message) {
+	for _, sub := range p.Policies {
+		preparePolicy(sub, mb, messages)
+	}
+}
+
+func (p *OrPolicy) String() string {
+	return joinPolicies(p.Policies, " OR ")
+}
+
+func joinPolicies(policies []RetentionPolicy, sep string) string {
+	s := ""
+	for i, p := range policies {
+		if i > 0 {
+			s += sep
+		}
+		if stringer, ok := p.(fmt.Stringer); ok {
+			s += stringer.String()
+		} else {
+			s += "policy"
+		}
+	}
+	return s
+}
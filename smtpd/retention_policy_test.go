@@ -0,0 +1,214 @@
+package smtpd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/log"
+)
+
+// newTestMailbox builds a fakeMailbox of n messages, newest first, dated
+// one minute apart, each of the given size.
+func newTestMailbox(name string, n int, size int64) (*fakeMailbox, []*fakeMessage) {
+	now := time.Now()
+	var msgs []*fakeMessage
+	var asMessages []Message
+	for i := 0; i < n; i++ {
+		m := &fakeMessage{
+			id:   name + "-" + string(rune('a'+i)),
+			date: now.Add(-time.Duration(i) * time.Minute),
+			size: size,
+		}
+		msgs = append(msgs, m)
+		asMessages = append(asMessages, m)
+	}
+	return &fakeMailbox{name: name, messages: asMessages}, msgs
+}
+
+func TestMaxMessagesPolicyKeepsExactlyMax(t *testing.T) {
+	mb, msgs := newTestMailbox("mb", 5, 100)
+	policy := &MaxMessagesPolicy{Max: 3}
+	policy.prepareMailbox(mb, mb.messages)
+
+	for i, m := range msgs {
+		keep, _ := policy.ShouldRetain(m, mb)
+		want := i < 3
+		if keep != want {
+			t.Errorf("message %d: ShouldRetain = %v, want %v", i, keep, want)
+		}
+	}
+}
+
+func TestMaxSizePolicySingleMessageOverCapIsDropped(t *testing.T) {
+	mb, msgs := newTestMailbox("mb", 1, 1000)
+	policy := &MaxSizePolicy{MaxBytes: 100}
+	policy.prepareMailbox(mb, mb.messages)
+
+	keep, reason := policy.ShouldRetain(msgs[0], mb)
+	if keep {
+		t.Fatalf("ShouldRetain = true, want false for a message exceeding MaxBytes on its own")
+	}
+	if reason == "" {
+		t.Errorf("expected a non-empty reason for rejection")
+	}
+}
+
+func TestMaxSizePolicyKeepsUnderCap(t *testing.T) {
+	mb, msgs := newTestMailbox("mb", 3, 40)
+	policy := &MaxSizePolicy{MaxBytes: 100}
+	policy.prepareMailbox(mb, mb.messages)
+
+	// 40+40=80 fits, a third 40 would push total to 120 > 100.
+	wantKeep := []bool{true, true, false}
+	for i, m := range msgs {
+		keep, _ := policy.ShouldRetain(m, mb)
+		if keep != wantKeep[i] {
+			t.Errorf("message %d: ShouldRetain = %v, want %v", i, keep, wantKeep[i])
+		}
+	}
+}
+
+func TestAndPolicyShortCircuitsOnFirstRejection(t *testing.T) {
+	mb, msgs := newTestMailbox("mb", 1, 100)
+	reject := rejectAlways{reason: "rejected by reject"}
+	spy := &spyPolicy{}
+	and := &AndPolicy{Policies: []RetentionPolicy{reject, spy}}
+
+	keep, reason := and.ShouldRetain(msgs[0], mb)
+	if keep {
+		t.Fatalf("AndPolicy.ShouldRetain = true, want false")
+	}
+	if reason != "rejected by reject" {
+		t.Errorf("reason = %q, want the rejecting sub-policy's reason", reason)
+	}
+	if spy.called {
+		t.Errorf("AndPolicy should short-circuit and skip later sub-policies once one rejects")
+	}
+}
+
+func TestOrPolicyRetainsIfAnySubPolicyRetains(t *testing.T) {
+	mb, msgs := newTestMailbox("mb", 1, 100)
+	reject := rejectAlways{reason: "rejected"}
+	or := &OrPolicy{Policies: []RetentionPolicy{reject, acceptAlways{}}}
+
+	keep, reason := or.ShouldRetain(msgs[0], mb)
+	if !keep {
+		t.Fatalf("OrPolicy.ShouldRetain = false, want true when one sub-policy retains")
+	}
+	if reason != "" {
+		t.Errorf("reason = %q, want empty when message is retained", reason)
+	}
+}
+
+func TestOrPolicyRejectsOnlyWhenAllSubPoliciesReject(t *testing.T) {
+	mb, msgs := newTestMailbox("mb", 1, 100)
+	or := &OrPolicy{Policies: []RetentionPolicy{
+		rejectAlways{reason: "first"},
+		rejectAlways{reason: "second"},
+	}}
+
+	keep, reason := or.ShouldRetain(msgs[0], mb)
+	if keep {
+		t.Fatalf("OrPolicy.ShouldRetain = true, want false when every sub-policy rejects")
+	}
+	if reason != "second" {
+		t.Errorf("reason = %q, want the last sub-policy's reason", reason)
+	}
+}
+
+func TestMaxMessagesPolicyResetClearsCachedState(t *testing.T) {
+	mb, msgs := newTestMailbox("mb", 2, 100)
+	policy := &MaxMessagesPolicy{Max: 1}
+	policy.prepareMailbox(mb, mb.messages)
+
+	if keep, _ := policy.ShouldRetain(msgs[0], mb); !keep {
+		t.Fatalf("expected newest message to be retained before reset")
+	}
+
+	policy.reset()
+
+	// Without a fresh prepareMailbox call, the policy has no ranking for
+	// this mailbox and must fail safe by retaining.
+	keep, _ := policy.ShouldRetain(msgs[0], mb)
+	if !keep {
+		t.Errorf("after reset, ShouldRetain without a prior prepareMailbox call should keep (fail safe), got false")
+	}
+}
+
+func TestMaxSizePolicyResetClearsCachedState(t *testing.T) {
+	mb, msgs := newTestMailbox("mb", 1, 1000)
+	policy := &MaxSizePolicy{MaxBytes: 10}
+	policy.prepareMailbox(mb, mb.messages)
+
+	if keep, _ := policy.ShouldRetain(msgs[0], mb); keep {
+		t.Fatalf("expected oversized message to be rejected before reset")
+	}
+
+	policy.reset()
+
+	// No prepareMailbox call since reset means no mailbox is known, so the
+	// retain set is empty and the message is rejected either way; assert
+	// the cache itself, not just behavior, was actually cleared.
+	policy.mu.Lock()
+	_, ok := policy.retain[mb.name]
+	policy.mu.Unlock()
+	if ok {
+		t.Errorf("reset() should have cleared the per-mailbox retain cache")
+	}
+}
+
+// rejectAlways is a RetentionPolicy that always rejects with reason.
+type rejectAlways struct {
+	reason string
+}
+
+func (r rejectAlways) ShouldRetain(msg Message, mb Mailbox) (bool, string) {
+	return false, r.reason
+}
+
+// acceptAlways is a RetentionPolicy that always retains.
+type acceptAlways struct{}
+
+func (acceptAlways) ShouldRetain(msg Message, mb Mailbox) (bool, string) {
+	return true, ""
+}
+
+// spyPolicy records whether ShouldRetain was called on it.
+type spyPolicy struct {
+	called bool
+}
+
+func (s *spyPolicy) ShouldRetain(msg Message, mb Mailbox) (bool, string) {
+	s.called = true
+	return true, ""
+}
+
+// countingMailbox wraps fakeMailbox to count GetMessages calls, so tests
+// can assert a mailbox is only listed once per scan.
+type countingMailbox struct {
+	*fakeMailbox
+	calls int
+}
+
+func (mb *countingMailbox) GetMessages() ([]Message, error) {
+	mb.calls++
+	return mb.fakeMailbox.GetMessages()
+}
+
+func TestComposedPolicyListsMailboxOnlyOnce(t *testing.T) {
+	inner, _ := newTestMailbox("mb", 4, 100)
+	mb := &countingMailbox{fakeMailbox: inner}
+
+	policy := &AndPolicy{Policies: []RetentionPolicy{
+		&MaxAgePolicy{MaxAge: time.Hour},
+		&MaxMessagesPolicy{Max: 2},
+		&MaxSizePolicy{MaxBytes: 1000},
+	}}
+
+	_, _, _, _ = scanMailbox(context.Background(), mb, policy, log.NewLogger())
+
+	if mb.calls != 1 {
+		t.Errorf("GetMessages called %d times, want exactly 1 across all composed policies", mb.calls)
+	}
+}
@@ -0,0 +1,92 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMessage is a minimal Message for exercising doRetentionScan.
+type fakeMessage struct {
+	id        string
+	date      time.Time
+	size      int64
+	deleteErr error
+
+	mu      sync.Mutex
+	deleted bool
+}
+
+func (m *fakeMessage) ID() string      { return m.id }
+func (m *fakeMessage) Date() time.Time { return m.date }
+func (m *fakeMessage) Size() int64     { return m.size }
+func (m *fakeMessage) Delete() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deleteErr != nil {
+		return m.deleteErr
+	}
+	m.deleted = true
+	return nil
+}
+
+func (m *fakeMessage) wasDeleted() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleted
+}
+
+// fakeMailbox is a minimal Mailbox backed by an in-memory message list.
+type fakeMailbox struct {
+	name     string
+	messages []Message
+}
+
+func (mb *fakeMailbox) Name() string                    { return mb.name }
+func (mb *fakeMailbox) GetMessages() ([]Message, error) { return mb.messages, nil }
+
+// fakeDataStore is a minimal DataStore backed by an in-memory mailbox list.
+type fakeDataStore struct {
+	mailboxes []Mailbox
+}
+
+func (ds *fakeDataStore) AllMailboxes() ([]Mailbox, error) { return ds.mailboxes, nil }
+
+// alwaysPurge is a RetentionPolicy that never retains anything, so every
+// message in the fixtures below gets a Delete() call.
+type alwaysPurge struct{}
+
+func (alwaysPurge) ShouldRetain(msg Message, mb Mailbox) (bool, string) {
+	return false, "test policy purges everything"
+}
+
+func TestDoRetentionScanWorkerErrorsDontHaltOthers(t *testing.T) {
+	failing := &fakeMessage{id: "bad-1", date: time.Now(), deleteErr: fmt.Errorf("boom")}
+	var mailboxes []Mailbox
+	mailboxes = append(mailboxes, &fakeMailbox{name: "broken", messages: []Message{failing}})
+
+	var okMessages []*fakeMessage
+	for i := 0; i < 5; i++ {
+		m := &fakeMessage{id: fmt.Sprintf("ok-%d", i), date: time.Now()}
+		okMessages = append(okMessages, m)
+		mailboxes = append(mailboxes, &fakeMailbox{name: fmt.Sprintf("mb-%d", i), messages: []Message{m}})
+	}
+
+	ds := &fakeDataStore{mailboxes: mailboxes}
+
+	err := doRetentionScan(context.Background(), ds, alwaysPurge{}, 4, 0, nil)
+	if err != nil {
+		t.Fatalf("doRetentionScan returned error: %v", err)
+	}
+
+	for _, m := range okMessages {
+		if !m.wasDeleted() {
+			t.Errorf("message %v should have been deleted despite sibling worker's error", m.id)
+		}
+	}
+	if failing.wasDeleted() {
+		t.Errorf("failing message should not report as deleted")
+	}
+}